@@ -0,0 +1,210 @@
+package common
+
+import "time"
+
+// SearchBuilder builds a SearchCriteria via chainable calls instead of
+// constructing the struct (with its many mutually exclusive fields) by
+// hand. The string, header and flag methods append to the accumulated
+// criteria, so repeating one composes as AND, e.g. .From("a").From("b")
+// requires both. Before, Since, Larger, Smaller, SeqSet and Uid set a single
+// value: calling one again replaces the earlier value.
+type SearchBuilder struct {
+	c *SearchCriteria
+}
+
+// NewSearchBuilder returns an empty SearchBuilder.
+func NewSearchBuilder() *SearchBuilder {
+	return &SearchBuilder{c: NewSearchCriteria()}
+}
+
+// Build returns the accumulated SearchCriteria.
+func (b *SearchBuilder) Build() *SearchCriteria {
+	return b.c
+}
+
+func (b *SearchBuilder) From(s string) *SearchBuilder {
+	b.c.From = append(b.c.From, s)
+	return b
+}
+
+func (b *SearchBuilder) To(s string) *SearchBuilder {
+	b.c.To = append(b.c.To, s)
+	return b
+}
+
+func (b *SearchBuilder) Bcc(s string) *SearchBuilder {
+	b.c.Bcc = append(b.c.Bcc, s)
+	return b
+}
+
+func (b *SearchBuilder) Subject(s string) *SearchBuilder {
+	b.c.Subject = append(b.c.Subject, s)
+	return b
+}
+
+func (b *SearchBuilder) Body(s string) *SearchBuilder {
+	b.c.Body = append(b.c.Body, s)
+	return b
+}
+
+func (b *SearchBuilder) Header(name, value string) *SearchBuilder {
+	b.c.Header.Add(name, value)
+	return b
+}
+
+func (b *SearchBuilder) WithFlag(flag string) *SearchBuilder {
+	b.c.WithFlags = append(b.c.WithFlags, flag)
+	return b
+}
+
+func (b *SearchBuilder) WithoutFlag(flag string) *SearchBuilder {
+	b.c.WithoutFlags = append(b.c.WithoutFlags, flag)
+	return b
+}
+
+func (b *SearchBuilder) Before(t time.Time) *SearchBuilder {
+	b.c.Before = &t
+	return b
+}
+
+func (b *SearchBuilder) Since(t time.Time) *SearchBuilder {
+	b.c.Since = &t
+	return b
+}
+
+func (b *SearchBuilder) Larger(n uint32) *SearchBuilder {
+	b.c.Larger = n
+	return b
+}
+
+func (b *SearchBuilder) Smaller(n uint32) *SearchBuilder {
+	b.c.Smaller = n
+	return b
+}
+
+func (b *SearchBuilder) SeqSet(s *SeqSet) *SearchBuilder {
+	b.c.SeqSet = s
+	return b
+}
+
+func (b *SearchBuilder) Uid(s *SeqSet) *SearchBuilder {
+	b.c.Uid = s
+	return b
+}
+
+// Not negates other, ANDed with whatever has already been built.
+func (b *SearchBuilder) Not(other *SearchBuilder) *SearchBuilder {
+	b.c.Not = append(b.c.Not, other.Build())
+	return b
+}
+
+// Or ORs left and right together, ANDed with whatever has already been
+// built.
+func (b *SearchBuilder) Or(left, right *SearchBuilder) *SearchBuilder {
+	b.c.Or = append(b.c.Or, [2]*SearchCriteria{left.Build(), right.Build()})
+	return b
+}
+
+// And merges other's accumulated criteria into b.
+func (b *SearchBuilder) And(other *SearchBuilder) *SearchBuilder {
+	oc := other.Build()
+
+	b.c.Answered = b.c.Answered || oc.Answered
+	b.c.Unanswered = b.c.Unanswered || oc.Unanswered
+	b.c.Deleted = b.c.Deleted || oc.Deleted
+	b.c.Undeleted = b.c.Undeleted || oc.Undeleted
+	b.c.Draft = b.c.Draft || oc.Draft
+	b.c.Undraft = b.c.Undraft || oc.Undraft
+	b.c.Flagged = b.c.Flagged || oc.Flagged
+	b.c.Unflagged = b.c.Unflagged || oc.Unflagged
+	b.c.Seen = b.c.Seen || oc.Seen
+	b.c.Unseen = b.c.Unseen || oc.Unseen
+	b.c.New = b.c.New || oc.New
+	b.c.Old = b.c.Old || oc.Old
+	b.c.Recent = b.c.Recent || oc.Recent
+
+	b.c.Bcc = append(b.c.Bcc, oc.Bcc...)
+	b.c.Body = append(b.c.Body, oc.Body...)
+	b.c.Cc = append(b.c.Cc, oc.Cc...)
+	b.c.From = append(b.c.From, oc.From...)
+	b.c.Subject = append(b.c.Subject, oc.Subject...)
+	b.c.Text = append(b.c.Text, oc.Text...)
+	b.c.To = append(b.c.To, oc.To...)
+
+	for name, values := range oc.Header {
+		for _, value := range values {
+			b.c.Header.Add(name, value)
+		}
+	}
+
+	b.c.WithFlags = append(b.c.WithFlags, oc.WithFlags...)
+	b.c.WithoutFlags = append(b.c.WithoutFlags, oc.WithoutFlags...)
+
+	// Before/SentBefore are upper bounds, Since/SentSince are lower bounds:
+	// ANDing two of either must tighten, not replace, the existing bound.
+	// On/SentOn are equality constraints with no meaningful "tighter" value
+	// when both sides set a (necessarily different) date, so the first one
+	// set wins.
+	b.c.Before = earlierTime(b.c.Before, oc.Before)
+	b.c.Since = laterTime(b.c.Since, oc.Since)
+	b.c.SentBefore = earlierTime(b.c.SentBefore, oc.SentBefore)
+	b.c.SentSince = laterTime(b.c.SentSince, oc.SentSince)
+	if b.c.On == nil {
+		b.c.On = oc.On
+	}
+	if b.c.SentOn == nil {
+		b.c.SentOn = oc.SentOn
+	}
+
+	// Larger is a lower bound (size > N): AND must tighten to the larger N.
+	if oc.Larger > b.c.Larger {
+		b.c.Larger = oc.Larger
+	}
+	// Smaller is an upper bound (size < N), with 0 meaning unset: AND must
+	// tighten to the smaller N.
+	if oc.Smaller != 0 && (b.c.Smaller == 0 || oc.Smaller < b.c.Smaller) {
+		b.c.Smaller = oc.Smaller
+	}
+
+	b.c.Not = append(b.c.Not, oc.Not...)
+	b.c.Or = append(b.c.Or, oc.Or...)
+
+	if oc.SeqSet != nil {
+		b.c.SeqSet = oc.SeqSet
+	}
+	if oc.Uid != nil {
+		b.c.Uid = oc.Uid
+	}
+
+	return b
+}
+
+// earlierTime returns whichever of a, b is the earlier upper bound,
+// treating nil as "no bound".
+func earlierTime(a, b *time.Time) *time.Time {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if b.Before(*a) {
+		return b
+	}
+	return a
+}
+
+// laterTime returns whichever of a, b is the later lower bound, treating
+// nil as "no bound".
+func laterTime(a, b *time.Time) *time.Time {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if b.After(*a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,38 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSearchBuilderAndTightensSize(t *testing.T) {
+	built := NewSearchBuilder().Larger(5000).And(NewSearchBuilder().Larger(100)).Build()
+	if built.Larger != 5000 {
+		t.Errorf("Larger = %d, want 5000 (AND must keep the stricter bound)", built.Larger)
+	}
+
+	built = NewSearchBuilder().Smaller(100).And(NewSearchBuilder().Smaller(5000)).Build()
+	if built.Smaller != 100 {
+		t.Errorf("Smaller = %d, want 100 (AND must keep the stricter bound)", built.Smaller)
+	}
+
+	built = NewSearchBuilder().And(NewSearchBuilder().Smaller(100)).Build()
+	if built.Smaller != 100 {
+		t.Errorf("Smaller = %d, want 100 (unset side must not clobber the other)", built.Smaller)
+	}
+}
+
+func TestSearchBuilderAndTightensDates(t *testing.T) {
+	earlier := time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+	later := time.Date(2021, time.June, 1, 0, 0, 0, 0, time.UTC)
+
+	built := NewSearchBuilder().Before(earlier).And(NewSearchBuilder().Before(later)).Build()
+	if !built.Before.Equal(earlier) {
+		t.Errorf("Before = %v, want %v (AND must keep the earlier bound)", built.Before, earlier)
+	}
+
+	built = NewSearchBuilder().Since(later).And(NewSearchBuilder().Since(earlier)).Build()
+	if !built.Since.Equal(later) {
+		t.Errorf("Since = %v, want %v (AND must keep the later bound)", built.Since, later)
+	}
+}
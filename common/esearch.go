@@ -0,0 +1,212 @@
+package common
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// resolveSavedSet returns the sequence set saved by a previous
+// "SEARCH ... RETURN (SAVE)" (RFC 5182), or an empty set if none was saved.
+func resolveSavedSet(ctx *SearchParseContext) *SeqSet {
+	if ctx == nil || ctx.SavedSet == nil {
+		return &SeqSet{}
+	}
+	return ctx.SavedSet
+}
+
+// SearchSavedSets persists the last "RETURN (SAVE)" result per connection
+// (RFC 5182 section 2), so that later FETCH/STORE/COPY/SEARCH commands on
+// the same connection can resolve the magic set "$" without every caller
+// having to thread the value through by hand. conn is an opaque per-
+// connection key (e.g. the net.Conn or the server's session object); this
+// package has no notion of a connection itself, so it's left up to the
+// caller to provide a stable, comparable key.
+type SearchSavedSets struct {
+	mu   sync.Mutex
+	sets map[interface{}]*SeqSet
+}
+
+// NewSearchSavedSets returns an empty SearchSavedSets.
+func NewSearchSavedSets() *SearchSavedSets {
+	return &SearchSavedSets{sets: make(map[interface{}]*SeqSet)}
+}
+
+// Save records set as conn's saved sequence set, replacing any previous one.
+func (s *SearchSavedSets) Save(conn interface{}, set *SeqSet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sets[conn] = set
+}
+
+// Load returns conn's saved sequence set, or nil if none has been saved.
+func (s *SearchSavedSets) Load(conn interface{}) *SeqSet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sets[conn]
+}
+
+// Clear discards conn's saved sequence set, e.g. on disconnect.
+func (s *SearchSavedSets) Clear(conn interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sets, conn)
+}
+
+// SearchOptions are the RETURN options of an extended SEARCH/UID SEARCH
+// command (RFC 4731 section 3, RFC 5182 section 2).
+type SearchOptions struct {
+	ReturnMin   bool
+	ReturnMax   bool
+	ReturnAll   bool
+	ReturnCount bool
+	ReturnSave  bool
+
+	// AllowRelativeDates opts a SearchCriteria.Parse call into accepting
+	// relative dates (see ParseRelativeSearchDate) wherever a strict RFC
+	// 3501 search date is expected. It's a user-facing ergonomic only: it
+	// never affects the wire format, since Format always emits the
+	// canonical form.
+	AllowRelativeDates bool
+}
+
+// Parse consumes a leading "RETURN (...)" from fields, if present, and
+// returns the remaining fields (the search criteria) unchanged. Fields not
+// starting with RETURN are returned as-is.
+func (o *SearchOptions) Parse(fields []interface{}) ([]interface{}, error) {
+	if len(fields) == 0 {
+		return fields, nil
+	}
+
+	f, ok := fields[0].(string)
+	if !ok || strings.ToUpper(f) != "RETURN" {
+		return fields, nil
+	}
+	if len(fields) < 2 {
+		return nil, errors.New("RETURN requires an option list")
+	}
+
+	opts, ok := fields[1].([]interface{})
+	if !ok {
+		return nil, errors.New("RETURN option list must be parenthesized")
+	}
+
+	for _, of := range opts {
+		s, ok := of.(string)
+		if !ok {
+			return nil, errors.New("Invalid RETURN option")
+		}
+
+		switch strings.ToUpper(s) {
+		case "MIN":
+			o.ReturnMin = true
+		case "MAX":
+			o.ReturnMax = true
+		case "ALL":
+			o.ReturnAll = true
+		case "COUNT":
+			o.ReturnCount = true
+		case "SAVE":
+			o.ReturnSave = true
+		default:
+			return nil, errors.New("Unknown RETURN option: " + s)
+		}
+	}
+
+	return fields[2:], nil
+}
+
+// Format formats the RETURN clause, or nil if no option is set.
+func (o *SearchOptions) Format() (fields []interface{}) {
+	if o == nil {
+		return nil
+	}
+
+	var opts []interface{}
+	if o.ReturnMin {
+		opts = append(opts, "MIN")
+	}
+	if o.ReturnMax {
+		opts = append(opts, "MAX")
+	}
+	if o.ReturnAll {
+		opts = append(opts, "ALL")
+	}
+	if o.ReturnCount {
+		opts = append(opts, "COUNT")
+	}
+	if o.ReturnSave {
+		opts = append(opts, "SAVE")
+	}
+	if len(opts) == 0 {
+		return nil
+	}
+
+	return []interface{}{"RETURN", opts}
+}
+
+// SearchCommand represents the full argument list of a SEARCH/UID SEARCH
+// command once the RFC 4731 RETURN extension is in play: an optional
+// leading "RETURN (...)" clause followed by the search criteria.
+type SearchCommand struct {
+	Options SearchOptions
+	Search  *SearchCriteria
+}
+
+// Parse decodes the fields following "SEARCH"/"UID SEARCH": an optional
+// "RETURN (...)" clause (see SearchOptions.Parse) followed by the search
+// criteria. ctx is forwarded to Search.Parse for charset decoding, "$"
+// resolution and relative-date handling; it may be nil.
+func (cmd *SearchCommand) Parse(fields []interface{}, ctx *SearchParseContext) error {
+	rest, err := cmd.Options.Parse(fields)
+	if err != nil {
+		return err
+	}
+
+	cmd.Search = NewSearchCriteria()
+	return cmd.Search.Parse(rest, ctx)
+}
+
+// Format encodes cmd back into the fields following "SEARCH"/"UID SEARCH".
+func (cmd *SearchCommand) Format() []interface{} {
+	fields := cmd.Options.Format()
+	if cmd.Search != nil {
+		fields = append(fields, cmd.Search.Format()...)
+	}
+	return fields
+}
+
+// SearchResult is the outcome of an extended SEARCH command (RFC 4731): the
+// subset of MIN/MAX/ALL/COUNT requested by SearchOptions.
+type SearchResult struct {
+	Tag   string
+	Min   uint32
+	Max   uint32
+	Count uint32
+	All   *SeqSet
+}
+
+// Format formats the result as ESEARCH response data fields (everything
+// after "* ESEARCH"), including only the items opts requested, e.g.
+// (TAG "x") UID MIN 1 MAX 100 ALL 1:3,5,7 COUNT 4.
+func (r *SearchResult) Format(uid bool, opts *SearchOptions) (fields []interface{}) {
+	fields = append(fields, []interface{}{"TAG", r.Tag})
+
+	if uid {
+		fields = append(fields, "UID")
+	}
+	if opts != nil && opts.ReturnMin {
+		fields = append(fields, "MIN", r.Min)
+	}
+	if opts != nil && opts.ReturnMax {
+		fields = append(fields, "MAX", r.Max)
+	}
+	if opts != nil && opts.ReturnAll && r.All != nil {
+		fields = append(fields, "ALL", r.All)
+	}
+	if opts != nil && opts.ReturnCount {
+		fields = append(fields, "COUNT", r.Count)
+	}
+
+	return
+}
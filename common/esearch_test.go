@@ -0,0 +1,148 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSearchOptionsParseFormat(t *testing.T) {
+	opts := &SearchOptions{}
+	rest, err := opts.Parse([]interface{}{"RETURN", []interface{}{"MIN", "MAX", "COUNT"}, "SEEN"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rest, []interface{}{"SEEN"}) {
+		t.Errorf("rest = %v, want [SEEN]", rest)
+	}
+	if !opts.ReturnMin || !opts.ReturnMax || !opts.ReturnCount || opts.ReturnAll || opts.ReturnSave {
+		t.Errorf("opts = %+v", opts)
+	}
+
+	got := opts.Format()
+	want := []interface{}{"RETURN", []interface{}{"MIN", "MAX", "COUNT"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Format() = %v, want %v", got, want)
+	}
+}
+
+func TestSearchOptionsParseNoReturn(t *testing.T) {
+	opts := &SearchOptions{}
+	fields := []interface{}{"SEEN"}
+	rest, err := opts.Parse(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rest, fields) {
+		t.Errorf("rest = %v, want %v unchanged", rest, fields)
+	}
+	if opts.Format() != nil {
+		t.Errorf("Format() = %v, want nil for no options set", opts.Format())
+	}
+}
+
+func TestSearchResultFormat(t *testing.T) {
+	all, err := NewSeqSet("1:3,5,7")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &SearchResult{Tag: "x", Min: 1, Max: 100, Count: 4, All: all}
+	opts := &SearchOptions{ReturnMin: true, ReturnMax: true, ReturnAll: true, ReturnCount: true}
+
+	fields := r.Format(true, opts)
+	want := []interface{}{
+		[]interface{}{"TAG", "x"},
+		"UID",
+		"MIN", uint32(1),
+		"MAX", uint32(100),
+		"ALL", all,
+		"COUNT", uint32(4),
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("Format() = %#v, want %#v", fields, want)
+	}
+}
+
+func TestSearchResultFormatOnlyRequestedItems(t *testing.T) {
+	r := &SearchResult{Tag: "x", Count: 4}
+	opts := &SearchOptions{ReturnCount: true}
+
+	fields := r.Format(false, opts)
+	want := []interface{}{[]interface{}{"TAG", "x"}, "COUNT", uint32(4)}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("Format() = %#v, want %#v", fields, want)
+	}
+}
+
+func TestSearchSavedSets(t *testing.T) {
+	s := NewSearchSavedSets()
+	conn := "conn-1"
+
+	if got := s.Load(conn); got != nil {
+		t.Errorf("Load before Save = %v, want nil", got)
+	}
+
+	set, err := NewSeqSet("1:5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Save(conn, set)
+
+	if got := s.Load(conn); got != set {
+		t.Errorf("Load = %v, want %v", got, set)
+	}
+
+	s.Clear(conn)
+	if got := s.Load(conn); got != nil {
+		t.Errorf("Load after Clear = %v, want nil", got)
+	}
+}
+
+func TestSearchCommandParseFormat(t *testing.T) {
+	cmd := &SearchCommand{}
+	fields := []interface{}{"RETURN", []interface{}{"ALL"}, "SEEN"}
+	if err := cmd.Parse(fields, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !cmd.Options.ReturnAll {
+		t.Errorf("Options.ReturnAll = false, want true")
+	}
+	if !cmd.Search.Seen {
+		t.Errorf("Search.Seen = false, want true")
+	}
+
+	got := cmd.Format()
+	want := []interface{}{"RETURN", []interface{}{"ALL"}, "SEEN"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Format() = %v, want %v", got, want)
+	}
+}
+
+func TestSearchCommandParseNoReturn(t *testing.T) {
+	cmd := &SearchCommand{}
+	if err := cmd.Parse([]interface{}{"SEEN"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if cmd.Options.Format() != nil {
+		t.Errorf("Options.Format() = %v, want nil for no RETURN clause", cmd.Options.Format())
+	}
+	if !reflect.DeepEqual(cmd.Format(), []interface{}{"SEEN"}) {
+		t.Errorf("Format() = %v, want [SEEN]", cmd.Format())
+	}
+}
+
+func TestSearchCriteriaResolvesSavedSet(t *testing.T) {
+	saved, err := NewSeqSet("1:5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewSearchCriteria()
+	ctx := &SearchParseContext{SavedSet: saved}
+	if err := c.Parse([]interface{}{"$"}, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if c.SeqSet != saved {
+		t.Errorf("SeqSet = %v, want %v", c.SeqSet, saved)
+	}
+}
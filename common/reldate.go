@@ -0,0 +1,82 @@
+package common
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var searchWeekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// ParseRelativeSearchDate parses a relative or natural-language date used
+// by higher-level callers building SearchCriteria (e.g. a CLI or a web UI),
+// relative to now: "today", "yesterday", "N days/weeks/months ago",
+// "last <weekday>", and ISO "2006-01-02".
+//
+// This is never used on the wire: RFC 3501 only allows the strict
+// "2-Jan-2006" form, which ParseSearchDate handles. Relative dates are only
+// parsed on ingress from higher-level callers via
+// SearchCriteria.Parse + SearchOptions.AllowRelativeDates.
+func ParseRelativeSearchDate(s string, now time.Time) (*time.Time, error) {
+	s = strings.TrimSpace(s)
+	lower := strings.ToLower(s)
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	switch lower {
+	case "today":
+		return &midnight, nil
+	case "yesterday":
+		t := midnight.AddDate(0, 0, -1)
+		return &t, nil
+	}
+
+	if t, err := time.ParseInLocation("2006-01-02", s, time.UTC); err == nil {
+		return &t, nil
+	}
+
+	if rest := strings.TrimPrefix(lower, "last "); rest != lower {
+		weekday, ok := searchWeekdays[strings.TrimSpace(rest)]
+		if !ok {
+			return nil, errors.New("Unknown weekday in relative date: " + rest)
+		}
+		days := (7 + int(now.Weekday()) - int(weekday)) % 7
+		if days == 0 {
+			// "last monday" said on a Monday means the previous Monday,
+			// not today.
+			days = 7
+		}
+		t := midnight.AddDate(0, 0, -days)
+		return &t, nil
+	}
+
+	fields := strings.Fields(lower)
+	if len(fields) == 3 && fields[2] == "ago" {
+		n, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, errors.New("Invalid relative date: " + s)
+		}
+
+		switch fields[1] {
+		case "day", "days":
+			t := midnight.AddDate(0, 0, -n)
+			return &t, nil
+		case "week", "weeks":
+			t := midnight.AddDate(0, 0, -7*n)
+			return &t, nil
+		case "month", "months":
+			t := midnight.AddDate(0, -n, 0)
+			return &t, nil
+		}
+	}
+
+	return nil, errors.New("Unrecognized relative date: " + s)
+}
@@ -0,0 +1,69 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRelativeSearchDateTodayYesterday(t *testing.T) {
+	now := time.Date(2021, time.June, 15, 14, 30, 0, 0, time.UTC)
+	wantToday := time.Date(2021, time.June, 15, 0, 0, 0, 0, time.UTC)
+	wantYesterday := time.Date(2021, time.June, 14, 0, 0, 0, 0, time.UTC)
+
+	got, err := ParseRelativeSearchDate("today", now)
+	if err != nil || !got.Equal(wantToday) {
+		t.Errorf("today: got %v, %v, want %v", got, err, wantToday)
+	}
+
+	got, err = ParseRelativeSearchDate("yesterday", now)
+	if err != nil || !got.Equal(wantYesterday) {
+		t.Errorf("yesterday: got %v, %v, want %v", got, err, wantYesterday)
+	}
+}
+
+func TestParseRelativeSearchDateAgo(t *testing.T) {
+	now := time.Date(2021, time.June, 15, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		in   string
+		want time.Time
+	}{
+		{"3 days ago", time.Date(2021, time.June, 12, 0, 0, 0, 0, time.UTC)},
+		{"2 weeks ago", time.Date(2021, time.June, 1, 0, 0, 0, 0, time.UTC)},
+		{"1 month ago", time.Date(2021, time.May, 15, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		got, err := ParseRelativeSearchDate(c.in, now)
+		if err != nil || !got.Equal(c.want) {
+			t.Errorf("%q: got %v, %v, want %v", c.in, got, err, c.want)
+		}
+	}
+}
+
+func TestParseRelativeSearchDateLastWeekday(t *testing.T) {
+	// 2021-06-15 is a Tuesday.
+	now := time.Date(2021, time.June, 15, 0, 0, 0, 0, time.UTC)
+
+	got, err := ParseRelativeSearchDate("last monday", now)
+	want := time.Date(2021, time.June, 14, 0, 0, 0, 0, time.UTC)
+	if err != nil || !got.Equal(want) {
+		t.Errorf("last monday (from Tuesday): got %v, %v, want %v", got, err, want)
+	}
+
+	// Asking "last tuesday" on a Tuesday must mean the previous Tuesday (7
+	// days back), not today.
+	got, err = ParseRelativeSearchDate("last tuesday", now)
+	want = time.Date(2021, time.June, 8, 0, 0, 0, 0, time.UTC)
+	if err != nil || !got.Equal(want) {
+		t.Errorf("last tuesday (from Tuesday): got %v, %v, want %v", got, err, want)
+	}
+}
+
+func TestParseRelativeSearchDateISO(t *testing.T) {
+	now := time.Date(2021, time.June, 15, 0, 0, 0, 0, time.UTC)
+	got, err := ParseRelativeSearchDate("2020-01-02", now)
+	want := time.Date(2020, time.January, 2, 0, 0, 0, 0, time.UTC)
+	if err != nil || !got.Equal(want) {
+		t.Errorf("ISO date: got %v, %v, want %v", got, err, want)
+	}
+}
@@ -2,6 +2,9 @@ package common
 
 import (
 	"errors"
+	"io"
+	"io/ioutil"
+	"net/textproto"
 	"strings"
 	"time"
 )
@@ -19,52 +22,145 @@ func FormatSearchDate(t *time.Time) string {
 	return t.Format(searchDateLayout)
 }
 
-// TODO: support AND with same fields (e.g. BCC mickey BCC mouse)
-
 // A search criteria.
 // See RFC 3501 section 6.4.4 for a description of each field.
+//
+// Fields that can be repeated on the wire (e.g. "BCC mickey BCC mouse") are
+// slices instead of scalars: each occurrence is appended, and the overall
+// result is the AND of all of them. Not and Or are repeatable for the same
+// reason.
 type SearchCriteria struct {
 	SeqSet *SeqSet
-	Answered bool
-	Bcc string
-	Before *time.Time
-	Body string
-	Cc string
-	Deleted bool
-	Draft bool
-	Flagged bool
-	From string
-	Header [2]string
-	Keyword string
-	Larger uint32
-	New bool
-	Not *SearchCriteria
-	Old bool
-	On *time.Time
-	Or [2]*SearchCriteria
-	Recent bool
-	Seen bool
+
+	Answered   bool
+	Unanswered bool
+	Deleted    bool
+	Undeleted  bool
+	Draft      bool
+	Undraft    bool
+	Flagged    bool
+	Unflagged  bool
+	Seen       bool
+	Unseen     bool
+	New        bool
+	Old        bool
+	Recent     bool
+
+	Bcc     []string
+	Body    []string
+	Cc      []string
+	From    []string
+	Subject []string
+	Text    []string
+	To      []string
+
+	Header textproto.MIMEHeader
+
+	WithFlags    []string
+	WithoutFlags []string
+
+	Before     *time.Time
+	On         *time.Time
+	Since      *time.Time
 	SentBefore *time.Time
-	SentOn *time.Time
-	SentSince *time.Time
-	Since *time.Time
+	SentOn     *time.Time
+	SentSince  *time.Time
+
+	Larger  uint32
 	Smaller uint32
-	Subject string
-	Text string
-	To string
+
+	Not []*SearchCriteria
+	Or  [][2]*SearchCriteria
+
 	Uid *SeqSet
-	Unanswered bool
-	Undeleted bool
-	Undraft bool
-	Unflagged bool
-	Unkeyword string
-	Unseen bool
+}
+
+// NewSearchCriteria creates a new SearchCriteria, ready to be populated by
+// repeated calls to Parse or by appending to its slice fields directly.
+func NewSearchCriteria() *SearchCriteria {
+	return &SearchCriteria{Header: make(textproto.MIMEHeader)}
+}
+
+// isASCII reports whether s only contains 7-bit characters, in which case
+// decoding it through a declared charset is unnecessary.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeCharset decodes s via charsetReader when it isn't plain ASCII.
+// charsetReader is expected to already be bound to the charset declared by
+// the client (via the CHARSET prefix); strings that are already 7-bit are
+// returned unchanged without invoking the reader.
+func decodeCharset(s string, charsetReader func(io.Reader) io.Reader) string {
+	if charsetReader == nil || isASCII(s) {
+		return s
+	}
+
+	r := charsetReader(strings.NewReader(s))
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return s
+	}
+	return string(b)
+}
+
+// SearchParseContext carries the per-connection state SearchCriteria.Parse
+// needs beyond the raw fields: how to decode non-ASCII literals, and which
+// saved sequence set the magic "$" (RFC 5182) refers to. It's passed
+// explicitly rather than stored on SearchCriteria or a package global so
+// that criteria parsing stays free of shared mutable state.
+type SearchParseContext struct {
+	// CharsetReader decodes non-ASCII literals, typically bound to the
+	// charset the client declared; may be nil, in which case literals are
+	// stored as-is.
+	CharsetReader func(io.Reader) io.Reader
+	// SavedSet is the sequence set saved by a previous SEARCH ... RETURN
+	// (SAVE), substituted wherever "$" appears in place of a sequence set.
+	// Callers typically populate this from a SearchSavedSets.Load for the
+	// current connection.
+	SavedSet *SeqSet
+	// Options carries flags that affect parsing itself, such as
+	// AllowRelativeDates; may be nil.
+	Options *SearchOptions
+}
+
+// parseSearchCriteriaDate parses a search date field, trying the strict RFC
+// 3501 form first and only falling back to ParseRelativeSearchDate when ctx
+// opts into it via Options.AllowRelativeDates.
+func parseSearchCriteriaDate(s string, ctx *SearchParseContext) (*time.Time, error) {
+	if t, err := ParseSearchDate(s); err == nil {
+		return t, nil
+	}
+	if ctx != nil && ctx.Options != nil && ctx.Options.AllowRelativeDates {
+		return ParseRelativeSearchDate(s, time.Now())
+	}
+	return nil, errors.New("Invalid search date: " + s)
 }
 
 // Parse search criteria from fields.
-func (c *SearchCriteria) Parse(fields []interface{}) error {
+//
+// A "CHARSET <name>" prefix is consumed and the name skipped. When
+// ctx.CharsetReader is set, it is used to decode non-ASCII literals (BCC,
+// BODY, TEXT, SUBJECT and HEADER values) into UTF-8 before they're stored,
+// whether or not a CHARSET prefix was present. ctx may be nil, in which case
+// literals are stored as-is and "$" resolves to an empty sequence set.
+func (c *SearchCriteria) Parse(fields []interface{}, ctx *SearchParseContext) error {
 	// TODO: do not panic when criteria is malformed
 
+	if c.Header == nil {
+		c.Header = make(textproto.MIMEHeader)
+	}
+
+	var charsetReader func(io.Reader) io.Reader
+	if ctx != nil {
+		charsetReader = ctx.CharsetReader
+	}
+
 	for i := 0; i < len(fields); i++ {
 		f, ok := fields[i].(string)
 		if !ok {
@@ -78,18 +174,26 @@ func (c *SearchCriteria) Parse(fields []interface{}) error {
 			c.Answered = true
 		case "BCC":
 			i++
-			c.Bcc, _ = fields[i].(string)
+			s, _ := fields[i].(string)
+			c.Bcc = append(c.Bcc, decodeCharset(s, charsetReader))
 		case "BEFORE":
 			i++
 			if date, ok := fields[i].(string); ok {
-				c.Before, _ = ParseSearchDate(date)
+				c.Before, _ = parseSearchCriteriaDate(date, ctx)
 			}
 		case "BODY":
 			i++
-			c.Body, _ = fields[i].(string)
+			s, _ := fields[i].(string)
+			c.Body = append(c.Body, decodeCharset(s, charsetReader))
 		case "CC":
 			i++
-			c.Cc, _ = fields[i].(string)
+			s, _ := fields[i].(string)
+			c.Cc = append(c.Cc, s)
+		case "CHARSET":
+			// Consumed here only to advance past the declared name; the
+			// caller is responsible for handing us a charsetReader already
+			// bound to it.
+			i++
 		case "DELETED":
 			c.Deleted = true
 		case "DRAFT":
@@ -98,7 +202,8 @@ func (c *SearchCriteria) Parse(fields []interface{}) error {
 			c.Flagged = true
 		case "FROM":
 			i++
-			c.From, _ = fields[i].(string)
+			s, _ := fields[i].(string)
+			c.From = append(c.From, s)
 		case "HEADER":
 			i++
 			name, _ := fields[i].(string)
@@ -106,10 +211,11 @@ func (c *SearchCriteria) Parse(fields []interface{}) error {
 			i++
 			value, _ := fields[i].(string)
 
-			c.Header = [2]string{name, value}
+			c.Header.Add(name, decodeCharset(value, charsetReader))
 		case "KEYWORD":
 			i++
-			c.Keyword, _ = fields[i].(string)
+			s, _ := fields[i].(string)
+			c.WithFlags = append(c.WithFlags, s)
 		case "LARGER":
 			i++
 			c.Larger, _ = ParseNumber(fields[i])
@@ -118,16 +224,17 @@ func (c *SearchCriteria) Parse(fields []interface{}) error {
 		case "NOT":
 			i++
 			not, _ := fields[i].([]interface{})
-			c.Not = &SearchCriteria{}
-			if err := c.Not.Parse(not); err != nil {
+			criteria := NewSearchCriteria()
+			if err := criteria.Parse(not, ctx); err != nil {
 				return err
 			}
+			c.Not = append(c.Not, criteria)
 		case "OLD":
 			c.Old = true
 		case "ON":
 			i++
 			if date, ok := fields[i].(string); ok {
-				c.On, _ = ParseSearchDate(date)
+				c.On, _ = parseSearchCriteriaDate(date, ctx)
 			}
 		case "OR":
 			i++
@@ -136,13 +243,14 @@ func (c *SearchCriteria) Parse(fields []interface{}) error {
 			i++
 			rightFields, _ := fields[i].([]interface{})
 
-			c.Or = [2]*SearchCriteria{&SearchCriteria{}, &SearchCriteria{}}
-			if err := c.Or[0].Parse(leftFields); err != nil {
+			left, right := NewSearchCriteria(), NewSearchCriteria()
+			if err := left.Parse(leftFields, ctx); err != nil {
 				return err
 			}
-			if err := c.Or[1].Parse(rightFields); err != nil {
+			if err := right.Parse(rightFields, ctx); err != nil {
 				return err
 			}
+			c.Or = append(c.Or, [2]*SearchCriteria{left, right})
 		case "RECENT":
 			c.Recent = true
 		case "SEEN":
@@ -150,39 +258,46 @@ func (c *SearchCriteria) Parse(fields []interface{}) error {
 		case "SENTBEFORE":
 			i++
 			if date, ok := fields[i].(string); ok {
-				c.SentBefore, _ = ParseSearchDate(date)
+				c.SentBefore, _ = parseSearchCriteriaDate(date, ctx)
 			}
 		case "SENTON":
 			i++
 			if date, ok := fields[i].(string); ok {
-				c.SentOn, _ = ParseSearchDate(date)
+				c.SentOn, _ = parseSearchCriteriaDate(date, ctx)
 			}
 		case "SENTSINCE":
 			i++
 			if date, ok := fields[i].(string); ok {
-				c.SentSince, _ = ParseSearchDate(date)
+				c.SentSince, _ = parseSearchCriteriaDate(date, ctx)
 			}
 		case "SINCE":
 			i++
 			if date, ok := fields[i].(string); ok {
-				c.Since, _ = ParseSearchDate(date)
+				c.Since, _ = parseSearchCriteriaDate(date, ctx)
 			}
 		case "SMALLER":
 			i++
 			c.Smaller, _ = ParseNumber(fields[i])
 		case "SUBJECT":
 			i++
-			c.Subject, _ = fields[i].(string)
+			s, _ := fields[i].(string)
+			c.Subject = append(c.Subject, decodeCharset(s, charsetReader))
 		case "TEXT":
 			i++
-			c.Text, _ = fields[i].(string)
+			s, _ := fields[i].(string)
+			c.Text = append(c.Text, decodeCharset(s, charsetReader))
 		case "TO":
 			i++
-			c.To, _ = fields[i].(string)
+			s, _ := fields[i].(string)
+			c.To = append(c.To, s)
 		case "UID":
 			i++
 			s, _ := fields[i].(string)
-			c.Uid, _ = NewSeqSet(s)
+			if s == "$" {
+				c.Uid = resolveSavedSet(ctx)
+			} else {
+				c.Uid, _ = NewSeqSet(s)
+			}
 		case "UNANSWERED":
 			c.Unanswered = true
 		case "UNDELETED":
@@ -193,9 +308,12 @@ func (c *SearchCriteria) Parse(fields []interface{}) error {
 			c.Unflagged = true
 		case "UNKEYWORD":
 			i++
-			c.Unkeyword, _ = fields[i].(string)
+			s, _ := fields[i].(string)
+			c.WithoutFlags = append(c.WithoutFlags, s)
 		case "UNSEEN":
 			c.Unseen = true
+		case "$":
+			c.SeqSet = resolveSavedSet(ctx)
 		default:
 			// Try to parse a sequence set
 			var err error
@@ -217,17 +335,17 @@ func (c *SearchCriteria) Format() (fields []interface{}) {
 	if c.Answered {
 		fields = append(fields, "ANSWERED")
 	}
-	if c.Bcc != "" {
-		fields = append(fields, "BCC", c.Bcc)
+	for _, s := range c.Bcc {
+		fields = append(fields, "BCC", s)
 	}
 	if c.Before != nil {
 		fields = append(fields, "BEFORE", FormatSearchDate(c.Before))
 	}
-	if c.Body != "" {
-		fields = append(fields, "BODY", c.Body)
+	for _, s := range c.Body {
+		fields = append(fields, "BODY", s)
 	}
-	if c.Cc != "" {
-		fields = append(fields, "CC", c.Cc)
+	for _, s := range c.Cc {
+		fields = append(fields, "CC", s)
 	}
 	if c.Deleted {
 		fields = append(fields, "DELETED")
@@ -238,14 +356,16 @@ func (c *SearchCriteria) Format() (fields []interface{}) {
 	if c.Flagged {
 		fields = append(fields, "FLAGGED")
 	}
-	if c.From != "" {
-		fields = append(fields, "FROM", c.From)
+	for _, s := range c.From {
+		fields = append(fields, "FROM", s)
 	}
-	if c.Header[0] != "" && c.Header[1] != "" {
-		fields = append(fields, "HEADER", c.Header[0], c.Header[1])
+	for name, values := range c.Header {
+		for _, value := range values {
+			fields = append(fields, "HEADER", name, value)
+		}
 	}
-	if c.Keyword != "" {
-		fields = append(fields, "KEYWORD", c.Keyword)
+	for _, s := range c.WithFlags {
+		fields = append(fields, "KEYWORD", s)
 	}
 	if c.Larger != 0 {
 		fields = append(fields, "LARGER", c.Larger)
@@ -253,8 +373,8 @@ func (c *SearchCriteria) Format() (fields []interface{}) {
 	if c.New {
 		fields = append(fields, "NEW")
 	}
-	if c.Not != nil {
-		fields = append(fields, "NOT", c.Not.Format())
+	for _, not := range c.Not {
+		fields = append(fields, "NOT", not.Format())
 	}
 	if c.Old {
 		fields = append(fields, "OLD")
@@ -262,8 +382,8 @@ func (c *SearchCriteria) Format() (fields []interface{}) {
 	if c.On != nil {
 		fields = append(fields, "ON", FormatSearchDate(c.On))
 	}
-	if c.Or[0] != nil && c.Or[1] != nil {
-		fields = append(fields, "OR", c.Or[0].Format(), c.Or[1].Format())
+	for _, or := range c.Or {
+		fields = append(fields, "OR", or[0].Format(), or[1].Format())
 	}
 	if c.Recent {
 		fields = append(fields, "RECENT")
@@ -284,16 +404,16 @@ func (c *SearchCriteria) Format() (fields []interface{}) {
 		fields = append(fields, "SINCE", FormatSearchDate(c.Since))
 	}
 	if c.Smaller != 0 {
-		fields = append(fields, "LARGER", c.Smaller)
+		fields = append(fields, "SMALLER", c.Smaller)
 	}
-	if c.Subject != "" {
-		fields = append(fields, "SUBJECT", c.Subject)
+	for _, s := range c.Subject {
+		fields = append(fields, "SUBJECT", s)
 	}
-	if c.Text != "" {
-		fields = append(fields, "TEXT", c.Text)
+	for _, s := range c.Text {
+		fields = append(fields, "TEXT", s)
 	}
-	if c.To != "" {
-		fields = append(fields, "TO", c.To)
+	for _, s := range c.To {
+		fields = append(fields, "TO", s)
 	}
 	if c.Uid != nil {
 		fields = append(fields, "UID", c.Uid)
@@ -310,8 +430,8 @@ func (c *SearchCriteria) Format() (fields []interface{}) {
 	if c.Unflagged {
 		fields = append(fields, "UNFLAGGED")
 	}
-	if c.Unkeyword != "" {
-		fields = append(fields, "UNKEYWORD")
+	for _, s := range c.WithoutFlags {
+		fields = append(fields, "UNKEYWORD", s)
 	}
 	if c.Unseen {
 		fields = append(fields, "UNSEEN")
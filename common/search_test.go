@@ -0,0 +1,210 @@
+package common
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// roundTrip parses c.Format() back into a fresh SearchCriteria and fails the
+// test if it doesn't deep-equal c.
+func roundTrip(t *testing.T, name string, c *SearchCriteria) {
+	t.Helper()
+
+	got := NewSearchCriteria()
+	if err := got.Parse(c.Format(), nil); err != nil {
+		t.Errorf("%s: Parse(Format()) failed: %v", name, err)
+		return
+	}
+	if !reflect.DeepEqual(got, c) {
+		t.Errorf("%s: Parse(Format()) = %+v, want %+v", name, got, c)
+	}
+}
+
+func TestSearchCriteriaRoundTripFlags(t *testing.T) {
+	c := NewSearchCriteria()
+	c.Answered = true
+	c.Unanswered = true
+	c.Deleted = true
+	c.Undeleted = true
+	c.Draft = true
+	c.Undraft = true
+	c.Flagged = true
+	c.Unflagged = true
+	c.Seen = true
+	c.Unseen = true
+	c.New = true
+	c.Old = true
+	c.Recent = true
+	roundTrip(t, "flags", c)
+}
+
+func TestSearchCriteriaRoundTripRepeatedStrings(t *testing.T) {
+	c := NewSearchCriteria()
+	c.Bcc = []string{"mickey", "mouse"}
+	c.Body = []string{"hello"}
+	c.Cc = []string{"donald"}
+	c.From = []string{"alice", "bob"}
+	c.Subject = []string{"re: hi"}
+	c.Text = []string{"world"}
+	c.To = []string{"carol"}
+	c.WithFlags = []string{"foo", "bar"}
+	c.WithoutFlags = []string{"baz"}
+	roundTrip(t, "repeated strings", c)
+}
+
+func TestSearchCriteriaRoundTripHeader(t *testing.T) {
+	c := NewSearchCriteria()
+	c.Header = textproto.MIMEHeader{}
+	c.Header.Add("X-Spam", "yes")
+	c.Header.Add("X-Spam", "maybe")
+	roundTrip(t, "header", c)
+}
+
+func TestSearchCriteriaRoundTripDates(t *testing.T) {
+	day := time.Date(2021, time.January, 2, 0, 0, 0, 0, time.UTC)
+
+	c := NewSearchCriteria()
+	c.Before = &day
+	c.On = &day
+	c.Since = &day
+	c.SentBefore = &day
+	c.SentOn = &day
+	c.SentSince = &day
+	roundTrip(t, "dates", c)
+}
+
+func TestSearchCriteriaRoundTripSizes(t *testing.T) {
+	c := NewSearchCriteria()
+	c.Larger = 1024
+	c.Smaller = 2048
+	roundTrip(t, "sizes", c)
+}
+
+func TestSearchCriteriaRoundTripNotAndOr(t *testing.T) {
+	c := NewSearchCriteria()
+	c.Not = append(c.Not, &SearchCriteria{Header: textproto.MIMEHeader{}, Deleted: true})
+	c.Or = append(c.Or, [2]*SearchCriteria{
+		{Header: textproto.MIMEHeader{}, Seen: true},
+		{Header: textproto.MIMEHeader{}, Flagged: true},
+	})
+	roundTrip(t, "not/or", c)
+}
+
+func TestSearchCriteriaRepeatedKeyAnds(t *testing.T) {
+	// BCC mickey BCC mouse must AND, not overwrite.
+	c := NewSearchCriteria()
+	if err := c.Parse([]interface{}{"BCC", "mickey", "BCC", "mouse"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c.Bcc, []string{"mickey", "mouse"}) {
+		t.Errorf("Bcc = %v, want [mickey mouse]", c.Bcc)
+	}
+}
+
+// panicReader fails the test if it's ever read from: used to prove ASCII
+// literals bypass the charset reader entirely.
+type panicReader struct{ t *testing.T }
+
+func (r panicReader) Read(p []byte) (int, error) {
+	r.t.Fatal("charsetReader invoked for an ASCII literal")
+	return 0, io.EOF
+}
+
+func TestDecodeCharsetBypassesASCII(t *testing.T) {
+	reader := func(io.Reader) io.Reader { return panicReader{t} }
+
+	c := NewSearchCriteria()
+	ctx := &SearchParseContext{CharsetReader: reader}
+	if err := c.Parse([]interface{}{"SUBJECT", "hello"}, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c.Subject, []string{"hello"}) {
+		t.Errorf("Subject = %v, want [hello]", c.Subject)
+	}
+}
+
+// upperCaseReader stands in for a real charset decoder: it proves the
+// reader returned by CharsetReader is actually applied to the literal.
+func upperCaseReader(r io.Reader) io.Reader {
+	b, _ := ioutil.ReadAll(r)
+	return strings.NewReader(strings.ToUpper(string(b)))
+}
+
+func TestDecodeCharsetAppliesReaderToNonASCII(t *testing.T) {
+	ctx := &SearchParseContext{CharsetReader: upperCaseReader}
+
+	c := NewSearchCriteria()
+	fields := []interface{}{
+		"BCC", "h\xc3\xa9llo",
+		"SUBJECT", "w\xc3\xb6rld",
+		"HEADER", "X-Greeting", "b\xc3\xa9njour",
+	}
+	if err := c.Parse(fields, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c.Bcc, []string{"H\xc3\x89LLO"}) {
+		t.Errorf("Bcc = %q, want [H\\xc3\\x89LLO] (upper-cased bytes)", c.Bcc)
+	}
+	if !reflect.DeepEqual(c.Subject, []string{"W\xc3\x96RLD"}) {
+		t.Errorf("Subject = %q, want [W\\xc3\\x96RLD] (upper-cased bytes)", c.Subject)
+	}
+	if got := c.Header.Get("X-Greeting"); got != "B\xc3\x89NJOUR" {
+		t.Errorf("Header[X-Greeting] = %q, want B\\xc3\\x89NJOUR (upper-cased bytes)", got)
+	}
+}
+
+func TestDecodeCharsetErrorFallsBackToOriginal(t *testing.T) {
+	failErr := errors.New("bad charset")
+	reader := func(io.Reader) io.Reader {
+		return errReader{failErr}
+	}
+
+	got := decodeCharset("n\xe9", reader)
+	if got != "n\xe9" {
+		t.Errorf("decodeCharset with failing reader = %q, want original string unchanged", got)
+	}
+}
+
+// errReader always fails, simulating a charsetReader given an unsupported
+// or malformed charset.
+type errReader struct{ err error }
+
+func (r errReader) Read(p []byte) (int, error) { return 0, r.err }
+
+func TestSearchCriteriaParseConsumesCharsetKeyword(t *testing.T) {
+	c := NewSearchCriteria()
+	ctx := &SearchParseContext{CharsetReader: upperCaseReader}
+	if err := c.Parse([]interface{}{"CHARSET", "UTF-8", "SEEN"}, ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !c.Seen {
+		t.Error("expected SEEN to be parsed after the CHARSET prefix was consumed")
+	}
+	if !reflect.DeepEqual(c.Format(), []interface{}{"SEEN"}) {
+		t.Errorf("Format() = %v, want [SEEN] (CHARSET must not become a criterion)", c.Format())
+	}
+}
+
+func TestSearchBuilder(t *testing.T) {
+	built := NewSearchBuilder().
+		From("a").
+		From("b").
+		WithFlag("foo").
+		Larger(100).
+		Build()
+
+	want := NewSearchCriteria()
+	want.From = []string{"a", "b"}
+	want.WithFlags = []string{"foo"}
+	want.Larger = 100
+
+	if !reflect.DeepEqual(built, want) {
+		t.Errorf("SearchBuilder = %+v, want %+v", built, want)
+	}
+}
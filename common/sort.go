@@ -0,0 +1,282 @@
+package common
+
+import (
+	"container/heap"
+	"errors"
+	"strings"
+	"time"
+)
+
+// A sort key, as defined in RFC 5256 section 3.
+type SortKey string
+
+const (
+	SortArrival SortKey = "ARRIVAL"
+	SortCc      SortKey = "CC"
+	SortDate    SortKey = "DATE"
+	SortFrom    SortKey = "FROM"
+	SortSize    SortKey = "SIZE"
+	SortSubject SortKey = "SUBJECT"
+	SortTo      SortKey = "TO"
+)
+
+// A single entry in a SORT criteria list: a key, optionally preceded by
+// REVERSE on the wire.
+type SortField struct {
+	Field   SortKey
+	Reverse bool
+}
+
+// Sort criteria, as used by the SORT command (RFC 5256 section 3). Fields
+// are applied in order, each one breaking ties left by the previous one.
+type SortCriteria []*SortField
+
+// Parse sort criteria from fields, e.g. ["REVERSE", "DATE", "SUBJECT"].
+func (c *SortCriteria) Parse(fields []interface{}) error {
+	var pendingReverse bool
+
+	for _, f := range fields {
+		s, ok := f.(string)
+		if !ok {
+			return errors.New("Invalid sort criteria field")
+		}
+
+		switch strings.ToUpper(s) {
+		case "REVERSE":
+			pendingReverse = true
+			continue
+		case "ARRIVAL", "CC", "DATE", "FROM", "SIZE", "SUBJECT", "TO":
+			*c = append(*c, &SortField{Field: SortKey(strings.ToUpper(s)), Reverse: pendingReverse})
+		default:
+			return errors.New("Unknown sort key: " + s)
+		}
+
+		pendingReverse = false
+	}
+
+	return nil
+}
+
+// Format sort criteria to fields.
+func (c SortCriteria) Format() (fields []interface{}) {
+	for _, field := range c {
+		if field.Reverse {
+			fields = append(fields, "REVERSE")
+		}
+		fields = append(fields, string(field.Field))
+	}
+	return
+}
+
+// SortCommand represents the full argument list of a SORT/UID SORT command
+// (RFC 5256 section 3): a parenthesized sort criteria, a declared charset,
+// and the search criteria restricting which messages get sorted.
+type SortCommand struct {
+	Criteria SortCriteria
+	Charset  string
+	Search   *SearchCriteria
+}
+
+// Parse decodes the fields following "SORT"/"UID SORT" on the wire:
+// "(<sort-criteria>) <charset> <search-criteria>". ctx is forwarded to
+// Search.Parse so charset decoding and "$" resolution work the same way
+// they do for a plain SEARCH command; it may be nil.
+func (cmd *SortCommand) Parse(fields []interface{}, ctx *SearchParseContext) error {
+	if len(fields) < 2 {
+		return errors.New("imap: SORT command expects sort criteria, a charset and a search criteria")
+	}
+
+	criteriaFields, ok := fields[0].([]interface{})
+	if !ok {
+		return errors.New("imap: SORT criteria must be a parenthesized list")
+	}
+	cmd.Criteria = nil
+	if err := cmd.Criteria.Parse(criteriaFields); err != nil {
+		return err
+	}
+
+	charset, ok := fields[1].(string)
+	if !ok {
+		return errors.New("imap: SORT charset must be a string")
+	}
+	cmd.Charset = charset
+
+	cmd.Search = NewSearchCriteria()
+	return cmd.Search.Parse(fields[2:], ctx)
+}
+
+// Format encodes cmd back into the fields following "SORT"/"UID SORT".
+func (cmd *SortCommand) Format() []interface{} {
+	fields := []interface{}{cmd.Criteria.Format(), cmd.Charset}
+	if cmd.Search != nil {
+		fields = append(fields, cmd.Search.Format()...)
+	}
+	return fields
+}
+
+// NormalizeSortSubject implements the [BASE-SUBJECT] algorithm from RFC
+// 5256 section 2.1: it strips leading "Re:"/"Fwd:" (and bracketed reply
+// counts) and surrounding whitespace so that replies thread and sort next
+// to their original message.
+func NormalizeSortSubject(subject string) string {
+	s := strings.TrimSpace(subject)
+
+	for {
+		trimmed := strings.TrimSpace(s)
+		changed := false
+
+		for _, prefix := range []string{"re:", "fwd:", "fw:"} {
+			if len(trimmed) >= len(prefix) && strings.EqualFold(trimmed[:len(prefix)], prefix) {
+				trimmed = strings.TrimSpace(trimmed[len(prefix):])
+				changed = true
+			}
+		}
+
+		if strings.HasPrefix(trimmed, "[") {
+			if end := strings.Index(trimmed, "]"); end >= 0 {
+				trimmed = strings.TrimSpace(trimmed[end+1:])
+				changed = true
+			}
+		}
+
+		if !changed {
+			s = trimmed
+			break
+		}
+		s = trimmed
+	}
+
+	return s
+}
+
+// A SortItem carries the fields of a message that sort criteria compare
+// against. ARRIVAL compares Arrival (the message's INTERNALDATE); DATE
+// compares Date (the message's Date header).
+type SortItem struct {
+	SeqNum  uint32
+	Arrival time.Time
+	Date    time.Time
+	From    string
+	To      string
+	Cc      string
+	Subject string
+	Size    uint32
+}
+
+// NewSortLess builds a "less than" comparator from sort criteria, falling
+// back through each field on ties and finally on sequence number.
+func NewSortLess(criteria SortCriteria) func(a, b *SortItem) bool {
+	return func(a, b *SortItem) bool {
+		for _, field := range criteria {
+			less, equal := compareSortField(field.Field, a, b)
+			if equal {
+				continue
+			}
+			if field.Reverse {
+				return !less
+			}
+			return less
+		}
+		return a.SeqNum < b.SeqNum
+	}
+}
+
+func compareSortField(key SortKey, a, b *SortItem) (less bool, equal bool) {
+	switch key {
+	case SortArrival:
+		return a.Arrival.Before(b.Arrival), a.Arrival.Equal(b.Arrival)
+	case SortDate:
+		return a.Date.Before(b.Date), a.Date.Equal(b.Date)
+	case SortSize:
+		return a.Size < b.Size, a.Size == b.Size
+	case SortFrom:
+		return a.From < b.From, a.From == b.From
+	case SortTo:
+		return a.To < b.To, a.To == b.To
+	case SortCc:
+		return a.Cc < b.Cc, a.Cc == b.Cc
+	case SortSubject:
+		as, bs := NormalizeSortSubject(a.Subject), NormalizeSortSubject(b.Subject)
+		return as < bs, as == bs
+	default:
+		return false, true
+	}
+}
+
+// sortHeap is a max-heap (by less) over a bounded window of items, used by
+// CollectTopK to keep only the K best candidates seen so far.
+type sortHeap struct {
+	items []*SortItem
+	less  func(a, b *SortItem) bool
+}
+
+func (h *sortHeap) Len() int { return len(h.items) }
+func (h *sortHeap) Less(i, j int) bool {
+	// Max-heap: the "worst" accepted item (by less) floats to the top so it
+	// can be evicted in O(log K) when a better candidate arrives.
+	return h.less(h.items[j], h.items[i])
+}
+func (h *sortHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *sortHeap) Push(x interface{}) {
+	h.items = append(h.items, x.(*SortItem))
+}
+func (h *sortHeap) Pop() interface{} {
+	old := h.items
+	n := len(old)
+	item := old[n-1]
+	h.items = old[:n-1]
+	return item
+}
+
+// CollectTopK returns the K smallest items (by less) out of items, sorted
+// ascending by less. It runs in O(N log K) using a bounded min-of-the-max
+// heap instead of sorting the full result set.
+func CollectTopK(items []*SortItem, less func(a, b *SortItem) bool, k int) []*SortItem {
+	if k <= 0 {
+		return nil
+	}
+
+	h := &sortHeap{less: less}
+	for _, item := range items {
+		if h.Len() < k {
+			heap.Push(h, item)
+			continue
+		}
+		if less(item, h.items[0]) {
+			h.items[0] = item
+			heap.Fix(h, 0)
+		}
+	}
+
+	sorted := make([]*SortItem, h.Len())
+	for i := len(sorted) - 1; i >= 0; i-- {
+		sorted[i] = heap.Pop(h).(*SortItem)
+	}
+	return sorted
+}
+
+// CollectPartial returns the items in positions from..to (1-indexed,
+// inclusive) of the full ascending order, for PARTIAL SORT (RFC 5267). It
+// still runs in O(N log to) rather than sorting the full result set: the
+// top `to` items are collected with the same bounded heap as CollectTopK,
+// then the requested window is sliced out of them. A from/to window beyond
+// the number of available items is truncated; from < 1 is clamped to 1.
+func CollectPartial(items []*SortItem, less func(a, b *SortItem) bool, from, to int) []*SortItem {
+	if from < 1 {
+		from = 1
+	}
+	if to < from {
+		return nil
+	}
+
+	top := CollectTopK(items, less, to)
+	if from > len(top) {
+		return nil
+	}
+
+	end := to
+	if end > len(top) {
+		end = len(top)
+	}
+	return top[from-1 : end]
+}
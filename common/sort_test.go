@@ -0,0 +1,144 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNormalizeSortSubject(t *testing.T) {
+	cases := map[string]string{
+		"Hello":           "Hello",
+		"Re: Hello":       "Hello",
+		"RE: Hello":       "Hello",
+		"Fwd: Hello":      "Hello",
+		"Re: Re: Hello":   "Hello",
+		"Re: [bug] Hello": "Hello",
+		"  Re:  Hello  ":  "Hello",
+	}
+	for in, want := range cases {
+		if got := NormalizeSortSubject(in); got != want {
+			t.Errorf("NormalizeSortSubject(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestNewSortLessFallback(t *testing.T) {
+	criteria := SortCriteria{
+		{Field: SortSubject},
+		{Field: SortDate},
+	}
+	less := NewSortLess(criteria)
+
+	a := &SortItem{SeqNum: 1, Subject: "Hello", Date: time.Unix(200, 0)}
+	b := &SortItem{SeqNum: 2, Subject: "Hello", Date: time.Unix(100, 0)}
+
+	// Same subject: falls back to DATE.
+	if !less(b, a) {
+		t.Errorf("expected b (earlier date) to sort before a")
+	}
+	if less(a, b) {
+		t.Errorf("expected a not to sort before b")
+	}
+}
+
+func TestNewSortLessReverse(t *testing.T) {
+	criteria := SortCriteria{{Field: SortSize, Reverse: true}}
+	less := NewSortLess(criteria)
+
+	small := &SortItem{SeqNum: 1, Size: 10}
+	big := &SortItem{SeqNum: 2, Size: 100}
+
+	if !less(big, small) {
+		t.Errorf("REVERSE SIZE: expected bigger item to sort first")
+	}
+}
+
+func TestCollectTopK(t *testing.T) {
+	items := []*SortItem{
+		{SeqNum: 1, Size: 5},
+		{SeqNum: 2, Size: 1},
+		{SeqNum: 3, Size: 3},
+		{SeqNum: 4, Size: 4},
+		{SeqNum: 5, Size: 2},
+	}
+	less := NewSortLess(SortCriteria{{Field: SortSize}})
+
+	top := CollectTopK(items, less, 3)
+	var got []uint32
+	for _, it := range top {
+		got = append(got, it.SeqNum)
+	}
+	want := []uint32{2, 5, 3} // sizes 1, 2, 3
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CollectTopK = %v, want %v", got, want)
+	}
+}
+
+func TestSortCommandParseFormat(t *testing.T) {
+	cmd := &SortCommand{}
+	fields := []interface{}{
+		[]interface{}{"REVERSE", "DATE", "SUBJECT"},
+		"UTF-8",
+		"SEEN",
+	}
+	if err := cmd.Parse(fields, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	want := SortCriteria{{Field: SortDate, Reverse: true}, {Field: SortSubject}}
+	if !reflect.DeepEqual(cmd.Criteria, want) {
+		t.Errorf("Criteria = %+v, want %+v", cmd.Criteria, want)
+	}
+	if cmd.Charset != "UTF-8" {
+		t.Errorf("Charset = %q, want UTF-8", cmd.Charset)
+	}
+	if !cmd.Search.Seen {
+		t.Errorf("Search.Seen = false, want true")
+	}
+
+	got := cmd.Format()
+	wantFields := []interface{}{
+		[]interface{}{"REVERSE", "DATE", "SUBJECT"},
+		"UTF-8",
+		"SEEN",
+	}
+	if !reflect.DeepEqual(got, wantFields) {
+		t.Errorf("Format() = %v, want %v", got, wantFields)
+	}
+}
+
+func TestSortCommandParseRequiresCriteriaAndCharset(t *testing.T) {
+	cmd := &SortCommand{}
+	if err := cmd.Parse([]interface{}{[]interface{}{"DATE"}}, nil); err == nil {
+		t.Error("expected an error when the charset/search criteria are missing")
+	}
+}
+
+func TestCollectPartial(t *testing.T) {
+	items := make([]*SortItem, 10)
+	for i := range items {
+		items[i] = &SortItem{SeqNum: uint32(i + 1), Size: uint32(10 - i)}
+	}
+	less := NewSortLess(SortCriteria{{Field: SortSize}})
+
+	window := CollectPartial(items, less, 3, 5)
+	var got []uint32
+	for _, it := range window {
+		got = append(got, it.SeqNum)
+	}
+	// Ascending by size: seqnums 10,9,8,7,6,5,4,3,2,1; positions 3..5 are
+	// seqnums 8,7,6.
+	want := []uint32{8, 7, 6}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CollectPartial(3,5) = %v, want %v", got, want)
+	}
+
+	if got := CollectPartial(items, less, 8, 20); len(got) != 3 {
+		t.Errorf("CollectPartial(8,20) truncated len = %d, want 3", len(got))
+	}
+
+	if got := CollectPartial(items, less, 50, 60); got != nil {
+		t.Errorf("CollectPartial out of range = %v, want nil", got)
+	}
+}
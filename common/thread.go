@@ -0,0 +1,334 @@
+package common
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A node in a THREAD response tree (RFC 5256 section 2). Children are
+// ordered as they should be serialized.
+type ThreadNode struct {
+	SeqNum   uint32
+	Children []*ThreadNode
+}
+
+// A message as seen by the threading algorithms: just enough information to
+// link it into a tree and order it against its siblings.
+type ThreadMessage struct {
+	SeqNum uint32
+	// MessageId is this message's Message-Id header, without angle brackets.
+	MessageId string
+	// References lists the In-Reply-To/References header message-ids this
+	// message points to, oldest (furthest ancestor) first and the
+	// immediate parent last.
+	References []string
+	Subject    string
+	Date       time.Time
+}
+
+// Thread runs the named THREAD algorithm ("ORDEREDSUBJECT" or
+// "REFERENCES") over messages and returns the resulting top-level threads.
+func Thread(algorithm string, messages []*ThreadMessage) []*ThreadNode {
+	switch algorithm {
+	case "ORDEREDSUBJECT":
+		return ThreadOrderedSubject(messages)
+	default:
+		return ThreadReferences(messages)
+	}
+}
+
+// ThreadOrderedSubject implements the ORDEREDSUBJECT algorithm from RFC
+// 5256 section 2.1: messages are grouped by their base (normalized)
+// subject, each group becomes a flat chain ordered by date, and the groups
+// themselves are ordered by the date of their first message.
+func ThreadOrderedSubject(messages []*ThreadMessage) []*ThreadNode {
+	groups := make(map[string][]*ThreadMessage)
+	var order []string
+
+	for _, m := range messages {
+		subj := NormalizeSortSubject(m.Subject)
+		if _, ok := groups[subj]; !ok {
+			order = append(order, subj)
+		}
+		groups[subj] = append(groups[subj], m)
+	}
+
+	type chain struct {
+		root *ThreadNode
+		date time.Time
+	}
+	chains := make([]chain, 0, len(order))
+
+	for _, subj := range order {
+		msgs := groups[subj]
+		sort.Slice(msgs, func(i, j int) bool { return msgs[i].Date.Before(msgs[j].Date) })
+
+		var head, tail *ThreadNode
+		for _, m := range msgs {
+			node := &ThreadNode{SeqNum: m.SeqNum}
+			if head == nil {
+				head = node
+			} else {
+				tail.Children = []*ThreadNode{node}
+			}
+			tail = node
+		}
+		chains = append(chains, chain{root: head, date: msgs[0].Date})
+	}
+
+	sort.Slice(chains, func(i, j int) bool { return chains[i].date.Before(chains[j].date) })
+
+	roots := make([]*ThreadNode, len(chains))
+	for i, c := range chains {
+		roots[i] = c.root
+	}
+	return roots
+}
+
+// ThreadCommand represents the full argument list of a THREAD/UID THREAD
+// command (RFC 5256 section 4): the algorithm name, a declared charset, and
+// the search criteria restricting which messages get threaded.
+type ThreadCommand struct {
+	Algorithm string
+	Charset   string
+	Search    *SearchCriteria
+}
+
+// Parse decodes the fields following "THREAD"/"UID THREAD" on the wire:
+// "<algorithm> <charset> <search-criteria>". ctx is forwarded to
+// Search.Parse so charset decoding and "$" resolution work the same way
+// they do for a plain SEARCH command; it may be nil.
+func (cmd *ThreadCommand) Parse(fields []interface{}, ctx *SearchParseContext) error {
+	if len(fields) < 2 {
+		return errors.New("imap: THREAD command expects an algorithm, a charset and a search criteria")
+	}
+
+	algorithm, ok := fields[0].(string)
+	if !ok {
+		return errors.New("imap: THREAD algorithm must be a string")
+	}
+	cmd.Algorithm = strings.ToUpper(algorithm)
+
+	charset, ok := fields[1].(string)
+	if !ok {
+		return errors.New("imap: THREAD charset must be a string")
+	}
+	cmd.Charset = charset
+
+	cmd.Search = NewSearchCriteria()
+	return cmd.Search.Parse(fields[2:], ctx)
+}
+
+// Format encodes cmd back into the fields following "THREAD"/"UID THREAD".
+func (cmd *ThreadCommand) Format() []interface{} {
+	fields := []interface{}{cmd.Algorithm, cmd.Charset}
+	if cmd.Search != nil {
+		fields = append(fields, cmd.Search.Format()...)
+	}
+	return fields
+}
+
+// A container is the REFERENCES algorithm's scratch node: it may represent
+// a real message, or an empty placeholder referenced by a Message-Id that
+// was never seen.
+type threadContainer struct {
+	id       string
+	msg      *ThreadMessage
+	parent   *threadContainer
+	children []*threadContainer
+}
+
+// ThreadReferences implements the REFERENCES algorithm from RFC 5256
+// section 2.2 (the JWZ threading algorithm): messages are linked into a
+// tree via their In-Reply-To/References headers, empty containers are
+// pruned or promoted, and root-level threads that came from an empty
+// container and share a subject are merged (see mergeThreadsBySubject).
+func ThreadReferences(messages []*ThreadMessage) []*ThreadNode {
+	idTable := make(map[string]*threadContainer)
+	var order []*threadContainer
+
+	getContainer := func(id string) *threadContainer {
+		if c, ok := idTable[id]; ok {
+			return c
+		}
+		c := &threadContainer{id: id}
+		idTable[id] = c
+		order = append(order, c)
+		return c
+	}
+
+	dates := make(map[uint32]time.Time)
+	subjects := make(map[uint32]string)
+
+	for _, m := range messages {
+		dates[m.SeqNum] = m.Date
+		subjects[m.SeqNum] = NormalizeSortSubject(m.Subject)
+
+		var prev *threadContainer
+		for _, ref := range m.References {
+			if ref == "" {
+				continue
+			}
+			c := getContainer(ref)
+			linkThreadContainer(prev, c)
+			prev = c
+		}
+
+		msgContainer := getContainer(m.MessageId)
+		msgContainer.msg = m
+		if prev != nil && prev != msgContainer {
+			linkThreadContainer(prev, msgContainer)
+		}
+	}
+
+	var topLevel []*ThreadNode
+	var fromDummy []bool
+	for _, c := range order {
+		if c.parent != nil {
+			continue
+		}
+		dummy := c.msg == nil
+		for _, n := range pruneThreadContainer(c) {
+			topLevel = append(topLevel, n)
+			fromDummy = append(fromDummy, dummy)
+		}
+	}
+
+	topLevel = mergeThreadsBySubject(topLevel, fromDummy, subjects, dates)
+	sortThreadsByDate(topLevel, dates)
+
+	return topLevel
+}
+
+// linkThreadContainer makes child a child of parent, refusing to do so if
+// child already has a parent or if linking would form a loop (i.e. child is
+// already an ancestor of parent).
+func linkThreadContainer(parent, child *threadContainer) {
+	if parent == nil || child == nil || parent == child || child.parent != nil {
+		return
+	}
+	for p := parent; p != nil; p = p.parent {
+		if p == child {
+			return
+		}
+	}
+	child.parent = parent
+	parent.children = append(parent.children, child)
+}
+
+// pruneThreadContainer converts c and its subtree into ThreadNodes,
+// dropping empty containers with no children and promoting the child of an
+// empty container that has exactly one.
+func pruneThreadContainer(c *threadContainer) []*ThreadNode {
+	var children []*ThreadNode
+	for _, ch := range c.children {
+		children = append(children, pruneThreadContainer(ch)...)
+	}
+
+	if c.msg == nil {
+		if len(children) == 0 {
+			return nil
+		}
+		if len(children) == 1 {
+			return children
+		}
+		// An empty container with several children carries no message of
+		// its own to serialize; promote its children to this level.
+		return children
+	}
+
+	return []*ThreadNode{{SeqNum: c.msg.SeqNum, Children: children}}
+}
+
+// mergeThreadsBySubject merges root-level threads whose normalized subject
+// matches, per RFC 5256 section 2.2 step 5. Only roots that came from an
+// empty (dummy) container are eligible: those have no References link to
+// tie them together, so the subject is our only hint they belong to the
+// same thread. Roots that are themselves real messages are left alone,
+// since two independent messages that merely share a subject are not the
+// same thread. The group is sorted by the date of its earliest message
+// (not by input order), and that earliest root becomes the parent of the
+// rest.
+func mergeThreadsBySubject(roots []*ThreadNode, fromDummy []bool, subjects map[uint32]string, dates map[uint32]time.Time) []*ThreadNode {
+	groups := make(map[string][]*ThreadNode)
+	var order []string
+	var merged []*ThreadNode
+
+	for i, r := range roots {
+		if !fromDummy[i] {
+			merged = append(merged, r)
+			continue
+		}
+
+		subj := subjects[r.SeqNum]
+		if _, ok := groups[subj]; !ok {
+			order = append(order, subj)
+		}
+		groups[subj] = append(groups[subj], r)
+	}
+
+	for _, subj := range order {
+		group := groups[subj]
+		if subj == "" || len(group) == 1 {
+			merged = append(merged, group...)
+			continue
+		}
+
+		sort.SliceStable(group, func(i, j int) bool {
+			return subtreeMinDate(group[i], dates).Before(subtreeMinDate(group[j], dates))
+		})
+		parent := group[0]
+		parent.Children = append(parent.Children, group[1:]...)
+		merged = append(merged, parent)
+	}
+	return merged
+}
+
+// sortThreadsByDate recursively sorts siblings by the date of the earliest
+// message in their subtree.
+func sortThreadsByDate(nodes []*ThreadNode, dates map[uint32]time.Time) {
+	for _, n := range nodes {
+		sortThreadsByDate(n.Children, dates)
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return subtreeMinDate(nodes[i], dates).Before(subtreeMinDate(nodes[j], dates))
+	})
+}
+
+func subtreeMinDate(n *ThreadNode, dates map[uint32]time.Time) time.Time {
+	min := dates[n.SeqNum]
+	for _, c := range n.Children {
+		if d := subtreeMinDate(c, dates); d.Before(min) {
+			min = d
+		}
+	}
+	return min
+}
+
+// FormatThreads formats top-level threads into the parenthesized response
+// fields described in RFC 5256 section 5, e.g. a flat chain formats as
+// (a b c) and a two-reply branch as (a (b)(c)). Each returned field is
+// either one root's []interface{} (to be written as a parenthesized list)
+// for callers to assemble into the full THREAD response.
+func FormatThreads(roots []*ThreadNode) (fields []interface{}) {
+	for _, root := range roots {
+		fields = append(fields, formatThreadNode(root))
+	}
+	return
+}
+
+func formatThreadNode(node *ThreadNode) []interface{} {
+	fields := []interface{}{node.SeqNum}
+
+	if len(node.Children) == 1 {
+		fields = append(fields, formatThreadNode(node.Children[0])...)
+	} else {
+		for _, child := range node.Children {
+			fields = append(fields, formatThreadNode(child))
+		}
+	}
+
+	return fields
+}
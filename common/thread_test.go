@@ -0,0 +1,200 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func seqNums(nodes []*ThreadNode) []uint32 {
+	var out []uint32
+	for _, n := range nodes {
+		out = append(out, n.SeqNum)
+	}
+	return out
+}
+
+func TestThreadOrderedSubject(t *testing.T) {
+	t0 := time.Unix(0, 0)
+	messages := []*ThreadMessage{
+		{SeqNum: 1, Subject: "Hello", Date: t0.Add(2 * time.Hour)},
+		{SeqNum: 2, Subject: "Re: Hello", Date: t0.Add(1 * time.Hour)},
+		{SeqNum: 3, Subject: "Other", Date: t0},
+	}
+
+	roots := ThreadOrderedSubject(messages)
+	if len(roots) != 2 {
+		t.Fatalf("expected 2 threads, got %d", len(roots))
+	}
+	// "Other" (t0) sorts before "Hello" group (earliest message at t0+1h).
+	if roots[0].SeqNum != 3 {
+		t.Errorf("first thread root = %d, want 3", roots[0].SeqNum)
+	}
+	// Within the "Hello" group, ordered by date: seq 2 then seq 1.
+	if roots[1].SeqNum != 2 || len(roots[1].Children) != 1 || roots[1].Children[0].SeqNum != 1 {
+		t.Errorf("second thread = %+v, want chain 2->1", roots[1])
+	}
+}
+
+func TestThreadReferencesChain(t *testing.T) {
+	t0 := time.Unix(0, 0)
+	messages := []*ThreadMessage{
+		{SeqNum: 1, MessageId: "a", Date: t0},
+		{SeqNum: 2, MessageId: "b", References: []string{"a"}, Date: t0.Add(time.Hour)},
+		{SeqNum: 3, MessageId: "c", References: []string{"a", "b"}, Date: t0.Add(2 * time.Hour)},
+	}
+
+	roots := ThreadReferences(messages)
+	if len(roots) != 1 {
+		t.Fatalf("expected 1 root, got %d: %+v", len(roots), roots)
+	}
+	if roots[0].SeqNum != 1 || len(roots[0].Children) != 1 || roots[0].Children[0].SeqNum != 2 ||
+		len(roots[0].Children[0].Children) != 1 || roots[0].Children[0].Children[0].SeqNum != 3 {
+		t.Errorf("expected chain 1->2->3, got %+v", roots[0])
+	}
+}
+
+func TestThreadReferencesBranch(t *testing.T) {
+	t0 := time.Unix(0, 0)
+	messages := []*ThreadMessage{
+		{SeqNum: 1, MessageId: "a", Date: t0},
+		{SeqNum: 2, MessageId: "b", References: []string{"a"}, Date: t0.Add(time.Hour)},
+		{SeqNum: 3, MessageId: "c", References: []string{"a"}, Date: t0.Add(2 * time.Hour)},
+	}
+
+	roots := ThreadReferences(messages)
+	if len(roots) != 1 || roots[0].SeqNum != 1 || len(roots[0].Children) != 2 {
+		t.Fatalf("expected a single root with two children, got %+v", roots)
+	}
+	if got := seqNums(roots[0].Children); !reflect.DeepEqual(got, []uint32{2, 3}) {
+		t.Errorf("children = %v, want [2 3]", got)
+	}
+
+	fields := FormatThreads(roots)
+	if !reflect.DeepEqual(fields, []interface{}{[]interface{}{uint32(1), []interface{}{uint32(2)}, []interface{}{uint32(3)}}}) {
+		t.Errorf("FormatThreads = %#v", fields)
+	}
+}
+
+func TestThreadReferencesDoesNotMergeUnrelatedSameSubject(t *testing.T) {
+	t0 := time.Unix(0, 0)
+	messages := []*ThreadMessage{
+		{SeqNum: 1, MessageId: "a", Subject: "Meeting", Date: t0},
+		{SeqNum: 2, MessageId: "b", Subject: "Meeting", Date: t0.Add(48 * time.Hour)},
+	}
+
+	roots := ThreadReferences(messages)
+	if len(roots) != 2 {
+		t.Fatalf("expected 2 independent roots, got %d: %+v", len(roots), roots)
+	}
+}
+
+func TestThreadReferencesDoesNotMergeDummyRootsWithDifferentSubjects(t *testing.T) {
+	t0 := time.Unix(0, 0)
+	// Each replies to a different message-id that was never seen, so each
+	// becomes a child of its own empty root container: eligible for
+	// subject-based merging, but their subjects differ, so they stay apart.
+	messages := []*ThreadMessage{
+		{SeqNum: 1, MessageId: "a", Subject: "Meeting", References: []string{"missing"}, Date: t0},
+		{SeqNum: 2, MessageId: "b", Subject: "Other", References: []string{"missing2"}, Date: t0.Add(time.Hour)},
+	}
+
+	roots := ThreadReferences(messages)
+	if len(roots) != 2 {
+		t.Fatalf("expected 2 independent threads (different subjects), got %d: %+v", len(roots), roots)
+	}
+}
+
+func TestThreadReferencesMergesSameMissingAncestorBySubject(t *testing.T) {
+	t0 := time.Unix(0, 0)
+	// Both reply to the same never-seen ancestor, with the same subject:
+	// their shared dummy parent is itself a root with two children, so
+	// they're eligible for (and expected to receive) a subject merge.
+	messages := []*ThreadMessage{
+		{SeqNum: 1, MessageId: "a", Subject: "Meeting", References: []string{"missing"}, Date: t0},
+		{SeqNum: 2, MessageId: "b", Subject: "Meeting", References: []string{"missing"}, Date: t0.Add(time.Hour)},
+	}
+
+	roots := ThreadReferences(messages)
+	if len(roots) != 1 {
+		t.Fatalf("expected the two same-subject orphans to merge into 1 thread, got %d: %+v", len(roots), roots)
+	}
+	if len(roots[0].Children) != 1 {
+		t.Errorf("expected one root with one child, got %+v", roots[0])
+	}
+}
+
+func TestThreadReferencesMergeParentIsEarliestByDateNotOrder(t *testing.T) {
+	t0 := time.Unix(0, 0)
+	// SeqNum 2 (the later message) appears first in the slice; the merge
+	// must still pick SeqNum 1 (the earlier message) as the parent.
+	messages := []*ThreadMessage{
+		{SeqNum: 2, MessageId: "b", Subject: "Meeting", References: []string{"missing"}, Date: t0.Add(time.Hour)},
+		{SeqNum: 1, MessageId: "a", Subject: "Meeting", References: []string{"missing"}, Date: t0},
+	}
+
+	roots := ThreadReferences(messages)
+	if len(roots) != 1 {
+		t.Fatalf("expected 1 merged thread, got %d: %+v", len(roots), roots)
+	}
+	if roots[0].SeqNum != 1 {
+		t.Errorf("merge parent = %d, want 1 (the earlier-dated message)", roots[0].SeqNum)
+	}
+	if len(roots[0].Children) != 1 || roots[0].Children[0].SeqNum != 2 {
+		t.Errorf("expected seq 2 as the sole child, got %+v", roots[0])
+	}
+}
+
+func TestThreadCommandParseFormat(t *testing.T) {
+	cmd := &ThreadCommand{}
+	fields := []interface{}{"references", "UTF-8", "SEEN"}
+	if err := cmd.Parse(fields, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.Algorithm != "REFERENCES" {
+		t.Errorf("Algorithm = %q, want REFERENCES", cmd.Algorithm)
+	}
+	if cmd.Charset != "UTF-8" {
+		t.Errorf("Charset = %q, want UTF-8", cmd.Charset)
+	}
+	if !cmd.Search.Seen {
+		t.Errorf("Search.Seen = false, want true")
+	}
+
+	got := cmd.Format()
+	want := []interface{}{"REFERENCES", "UTF-8", "SEEN"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Format() = %v, want %v", got, want)
+	}
+}
+
+func TestThreadCommandParseRequiresCharsetAndSearch(t *testing.T) {
+	cmd := &ThreadCommand{}
+	if err := cmd.Parse([]interface{}{"REFERENCES"}, nil); err == nil {
+		t.Error("expected an error when the charset/search criteria are missing")
+	}
+}
+
+func TestThreadReferencesNoLoop(t *testing.T) {
+	t0 := time.Unix(0, 0)
+	// a references b, b references a: must not deadlock or create a cycle.
+	messages := []*ThreadMessage{
+		{SeqNum: 1, MessageId: "a", References: []string{"b"}, Date: t0},
+		{SeqNum: 2, MessageId: "b", References: []string{"a"}, Date: t0.Add(time.Hour)},
+	}
+
+	roots := ThreadReferences(messages)
+	total := 0
+	var count func([]*ThreadNode)
+	count = func(nodes []*ThreadNode) {
+		for _, n := range nodes {
+			total++
+			count(n.Children)
+		}
+	}
+	count(roots)
+	if total != 2 {
+		t.Errorf("expected both messages to appear exactly once, got %d nodes across %d roots", total, len(roots))
+	}
+}